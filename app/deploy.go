@@ -5,10 +5,14 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/tsuru/tsuru/db"
@@ -17,6 +21,7 @@ import (
 	"github.com/tsuru/tsuru/log"
 	"github.com/tsuru/tsuru/permission"
 	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/repository"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -34,6 +39,31 @@ const (
 
 var reImageVersion = regexp.MustCompile("v[0-9]+$")
 
+// SourceEpoch selects how the timestamp baked into the image produced by a
+// deploy is resolved. Besides the named values below, any RFC3339 string is
+// accepted as an explicit override.
+type SourceEpoch string
+
+const (
+	// SourceEpochZero bakes the Unix epoch (0) into the produced image,
+	// making builds reproducible regardless of when they run.
+	SourceEpochZero SourceEpoch = "zero"
+	// SourceEpochSourceTimestamp uses the commit or archive mtime as the
+	// image timestamp, resolved through the existing git/archive metadata
+	// path. Only supported for DeployGit and DeployArchiveURL.
+	SourceEpochSourceTimestamp SourceEpoch = "source-timestamp"
+	// SourceEpochBuildTimestamp uses the current wall-clock time, matching
+	// the historical (non-reproducible) behavior. It's the default when
+	// SourceEpoch is empty.
+	SourceEpochBuildTimestamp SourceEpoch = "build-timestamp"
+)
+
+// ErrOutputTimestampValueNotSupported is returned when an archive or upload
+// deploy requests a SourceEpoch but the app's provisioner implements neither
+// provision.ReproducibleDeployer nor provision.CancellableDeployer. Image
+// deploys and rollbacks don't pass a SourceEpoch to the provisioner.
+var ErrOutputTimestampValueNotSupported = fmt.Errorf("provisioner does not support pinning the output image timestamp")
+
 type DeployData struct {
 	ID          bson.ObjectId `bson:"_id,omitempty"`
 	App         string
@@ -48,6 +78,15 @@ type DeployData struct {
 	CanRollback bool
 	RemoveDate  time.Time `bson:",omitempty"`
 	Diff        string
+	SourceEpoch string
+	// ResolvedSourceEpoch is the RFC3339 timestamp that was actually baked
+	// into the image, as resolved by deployToProvisioner and handed to the
+	// provisioner.
+	ResolvedSourceEpoch string
+	// Schema1Converted reports whether this deploy had to fall back to
+	// pulling a deprecated Docker manifest v2 schema1 image and convert it
+	// to schema2, so operators can find apps still using legacy registries.
+	Schema1Converted bool
 }
 
 func findValidImages(apps ...App) (set, error) {
@@ -129,6 +168,7 @@ func eventToDeployData(evt *event.Event, validImages set, full bool) *DeployData
 	if err == nil {
 		data.Commit = startOpts.Commit
 		data.Origin = startOpts.Origin
+		data.SourceEpoch = string(startOpts.SourceEpoch)
 	}
 	if full {
 		data.Log = evt.Log
@@ -142,8 +182,21 @@ func eventToDeployData(evt *event.Event, validImages set, full bool) *DeployData
 	err = evt.EndData(&endData)
 	if err == nil {
 		data.Image = endData["image"]
+		data.ResolvedSourceEpoch = endData["source-epoch"]
+		data.Schema1Converted = endData["schema1_converted"] == "true"
 		if validImages != nil {
 			data.CanRollback = validImages.Includes(data.Image)
+			if !data.CanRollback {
+				// When the provisioner returned a digest-pinned image
+				// (as a MultiArchImageDeployer may for the manifest in
+				// opts.ResolvedManifest), it's recorded as is, while
+				// ValidAppImages reports the floating multi-arch tag.
+				// Strip the digest and check the tag instead, so
+				// per-platform entries still show up as rollback-able.
+				if name, digest := splitImageDigest(data.Image); digest != "" {
+					data.CanRollback = validImages.Includes(name)
+				}
+			}
 			if reImageVersion.MatchString(data.Image) {
 				parts := reImageVersion.FindAllStringSubmatch(data.Image, -1)
 				data.Image = parts[0][0]
@@ -168,6 +221,25 @@ type DeployOptions struct {
 	Event        *event.Event `bson:"-"`
 	Kind         DeployKind
 	Message      string
+	// SourceEpoch controls the timestamp baked into the produced image. It
+	// accepts the named SourceEpoch* values or an explicit RFC3339
+	// timestamp. Empty behaves like SourceEpochBuildTimestamp.
+	SourceEpoch SourceEpoch
+	// Platform selects which manifest to pull when Image references an OCI
+	// image index or Docker manifest list. With the zero value, a
+	// provision.MultiArchImageDeployer deploys the first manifest it lists;
+	// other provisioners pick on their own.
+	Platform provision.Platform
+	// Schema1Converted is set by deployToProvisioner when Image had to be
+	// pulled as deprecated Docker manifest v2 schema1 and converted to
+	// schema2 on ingestion. It's an outcome, not an input, so it isn't part
+	// of the persisted start data.
+	Schema1Converted bool `bson:"-"`
+	// ResolvedManifest is set by deployToProvisioner, for
+	// provision.MultiArchImageDeployer provisioners, to the concrete
+	// manifest selected out of Image's manifest list. It's an outcome, not
+	// an input, so it isn't part of the persisted start data.
+	ResolvedManifest provision.ManifestDescriptor `bson:"-"`
 }
 
 func (o *DeployOptions) GetKind() (kind DeployKind) {
@@ -192,33 +264,185 @@ func (o *DeployOptions) GetKind() (kind DeployKind) {
 	return DeployArchiveURL
 }
 
+// resolveSourceEpoch returns the timestamp that should be baked into the
+// image produced by opts, based on opts.SourceEpoch.
+func resolveSourceEpoch(opts *DeployOptions) (time.Time, error) {
+	switch SourceEpoch(opts.SourceEpoch) {
+	case "", SourceEpochBuildTimestamp:
+		return time.Now().UTC(), nil
+	case SourceEpochZero:
+		return time.Unix(0, 0).UTC(), nil
+	case SourceEpochSourceTimestamp:
+		switch opts.GetKind() {
+		case DeployGit:
+			return repository.CommitTimestamp(opts.App.Name, opts.Commit)
+		case DeployArchiveURL:
+			return archiveTimestamp(opts.ArchiveURL)
+		default:
+			return time.Time{}, fmt.Errorf("source-timestamp epoch is only supported for git and archive-url deploys")
+		}
+	default:
+		t, err := time.Parse(time.RFC3339, string(opts.SourceEpoch))
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid source epoch %q: %s", opts.SourceEpoch, err)
+		}
+		return t, nil
+	}
+}
+
+// archiveTimestamp resolves the mtime of a remote archive from the
+// Last-Modified header of a HEAD request, for use as a reproducible
+// SourceEpochSourceTimestamp.
+func archiveTimestamp(archiveURL string) (time.Time, error) {
+	resp, err := http.Head(archiveURL)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	lastModified := resp.Header.Get("Last-Modified")
+	if lastModified == "" {
+		return time.Time{}, fmt.Errorf("archive at %q does not provide a Last-Modified header", archiveURL)
+	}
+	return http.ParseTime(lastModified)
+}
+
+// DeployProgress is a single structured progress update emitted during a
+// deploy. It's written to the event log as one JSON object per line, so
+// tsuruIo.NoErrorWriter based CLI progress bars can parse it, while still
+// reading fine as plain text.
+type DeployProgress struct {
+	Phase            string        `json:"phase"`
+	Percent          float64       `json:"percent"`
+	BytesTransferred int64         `json:"bytesTransferred"`
+	ETA              time.Duration `json:"eta"`
+}
+
+func (p DeployProgress) String() string {
+	return fmt.Sprintf("[%s] %.0f%% (%d bytes, eta %s)", p.Phase, p.Percent, p.BytesTransferred, p.ETA)
+}
+
+// reportProgress writes p to evt's log as a single line of JSON, falling
+// back to its human-readable form if marshaling somehow fails.
+func reportProgress(evt *event.Event, p DeployProgress) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		evt.Logf("%s", p)
+		return
+	}
+	evt.Logf("%s", data)
+}
+
+var (
+	runningDeploysMu sync.Mutex
+	runningDeploys   = map[bson.ObjectId]context.CancelFunc{}
+)
+
+// CancelDeploy requests cancellation of the running deploy tied to
+// eventID. It marks the underlying event as cancelled, not errored, and -
+// if the deploy is still running on this node - cancels its context so
+// deployToProvisioner (and any provision.CancellableDeployer it calls)
+// can abort cleanly.
+func CancelDeploy(eventID bson.ObjectId, reason string) error {
+	evt, err := event.GetByID(eventID)
+	if err != nil {
+		return err
+	}
+	err = evt.TryCancel(reason, "")
+	if err != nil {
+		return err
+	}
+	runningDeploysMu.Lock()
+	cancel, ok := runningDeploys[eventID]
+	runningDeploysMu.Unlock()
+	if ok {
+		cancel()
+	}
+	return nil
+}
+
 // Deploy runs a deployment of an application. It will first try to run an
 // archive based deploy (if opts.ArchiveURL is not empty), and then fallback to
-// the Git based deployment.
-func Deploy(opts DeployOptions) (string, error) {
+// the Git based deployment. ctx is cancelled when CancelDeploy is called for
+// opts.Event; provisioners implementing provision.CancellableDeployer must
+// abort cleanly when that happens. Before returning, it always finalizes
+// opts.Event with the resolved image and SourceEpoch, so eventToDeployData
+// can report them back through ListDeploys/GetDeploy regardless of how the
+// deploy ends.
+func Deploy(ctx context.Context, opts DeployOptions) (imageId string, err error) {
 	if opts.Event == nil {
 		return "", fmt.Errorf("missing event in deploy opts")
 	}
-	if opts.Rollback && !regexp.MustCompile(":v[0-9]+$").MatchString(opts.Image) {
-		validImages, err := findValidImages(*opts.App)
-		if err == nil {
-			inputImage := opts.Image
-			for img := range validImages {
-				if strings.HasSuffix(img, opts.Image) {
-					opts.Image = img
-					break
-				}
-			}
-			if opts.Image == inputImage {
-				return "", fmt.Errorf("invalid version: %q", inputImage)
-			}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	runningDeploysMu.Lock()
+	runningDeploys[opts.Event.UniqueID] = cancel
+	runningDeploysMu.Unlock()
+	defer func() {
+		runningDeploysMu.Lock()
+		delete(runningDeploys, opts.Event.UniqueID)
+		runningDeploysMu.Unlock()
+	}()
+	// endData is what eventToDeployData reads back as DeployData.Image,
+	// DeployData.ResolvedSourceEpoch and DeployData.Schema1Converted; it has
+	// to be written here, since this is the only place that ever learns the
+	// SourceEpoch actually baked into the image (deployToProvisioner's
+	// return value, not opts.SourceEpoch, which is only the request) and
+	// whether deploySchema1Fallback had to kick in.
+	var sourceEpoch time.Time
+	defer func() {
+		endData := map[string]string{"image": imageId}
+		if !sourceEpoch.IsZero() {
+			endData["source-epoch"] = sourceEpoch.Format(time.RFC3339)
 		}
+		if opts.Schema1Converted {
+			endData["schema1_converted"] = "true"
+		}
+		opts.Event.DoneCustomData(err, endData)
+	}()
+	var rollbackArtifact *Artifact
+	if opts.Rollback {
+		release, err := resolveRollbackRelease(*opts.App, opts.Image)
+		if err != nil {
+			return "", err
+		}
+		rollbackArtifact, err = GetArtifact(release.ArtifactID)
+		if err != nil {
+			return "", err
+		}
+		opts.Image = rollbackArtifact.Image
 	}
 	logWriter := LogWriter{App: opts.App}
 	logWriter.Async()
 	defer logWriter.Close()
 	opts.Event.SetLogWriter(io.MultiWriter(&tsuruIo.NoErrorWriter{Writer: opts.OutputStream}, &logWriter))
-	imageId, err := deployToProvisioner(&opts, opts.Event)
+	imageId, sourceEpoch, err = deployToProvisioner(ctx, &opts, opts.Event)
+	if err != nil {
+		return "", err
+	}
+	artifact := rollbackArtifact
+	if artifact == nil {
+		digest := opts.ResolvedManifest.Digest
+		platform := opts.Platform
+		if digest == "" {
+			_, digest = splitImageDigest(imageId)
+		} else {
+			platform = opts.ResolvedManifest.Platform
+		}
+		artifact, err = CreateArtifact(CreateArtifactOpts{
+			App:              opts.App,
+			Image:            imageId,
+			Digest:           digest,
+			Platform:         platform,
+			SourceRef:        opts.Commit,
+			Origin:           opts.Origin,
+			Schema1Converted: opts.Schema1Converted,
+			SourceEpoch:      sourceEpoch,
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	_, err = CreateRelease(opts.App, artifact, nil)
 	if err != nil {
 		return "", err
 	}
@@ -232,29 +456,182 @@ func Deploy(opts DeployOptions) (string, error) {
 	return imageId, nil
 }
 
-func deployToProvisioner(opts *DeployOptions, evt *event.Event) (string, error) {
+// deployToProvisioner runs the deploy and returns the image id together
+// with the SourceEpoch that was actually used (zero if none was
+// requested). Returning it here - rather than having callers recompute it
+// from opts afterwards - matters for SourceEpochBuildTimestamp: "now" at
+// resolution time is the timestamp that got baked into the image, and
+// calling resolveSourceEpoch a second time would return a different "now".
+func deployToProvisioner(ctx context.Context, opts *DeployOptions, evt *event.Event) (string, time.Time, error) {
 	prov, err := opts.App.getProvisioner()
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
+	}
+	reportProgress(evt, DeployProgress{Phase: "starting"})
+	var sourceEpoch time.Time
+	if opts.SourceEpoch != "" {
+		sourceEpoch, err = resolveSourceEpoch(opts)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	// Resolve the manifest before even checking CancellableDeployer: a
+	// provisioner can implement both CancellableDeployer and
+	// MultiArchImageDeployer, and deployCancellable forwards opts.Image
+	// and opts.Platform as-is, so without this opts.ResolvedManifest would
+	// stay zero and Deploy would fall back to recording the requested
+	// platform instead of the manifest that was actually deployed.
+	var multiArch provision.MultiArchImageDeployer
+	if opts.GetKind() == DeployImage {
+		if d, ok := prov.(provision.MultiArchImageDeployer); ok {
+			multiArch = d
+			manifests, merr := d.ListImageManifests(opts.App, opts.Image, evt)
+			if merr != nil {
+				return "", sourceEpoch, merr
+			}
+			manifest, ok := provision.SelectManifest(manifests, opts.Platform)
+			if !ok {
+				return "", sourceEpoch, fmt.Errorf("no manifest in %q matches the requested platform", opts.Image)
+			}
+			opts.ResolvedManifest = manifest
+		}
+	}
+	if deployer, ok := prov.(provision.CancellableDeployer); ok {
+		return deployCancellable(ctx, prov, deployer, opts, sourceEpoch, evt)
 	}
 	switch opts.GetKind() {
 	case DeployRollback:
-		return prov.Rollback(opts.App, opts.Image, evt)
+		imgID, err := prov.Rollback(opts.App, opts.Image, evt)
+		return imgID, sourceEpoch, err
 	case DeployImage:
+		if multiArch != nil {
+			imgID, err := multiArch.ImageDeployManifest(opts.App, opts.Image, opts.ResolvedManifest, evt)
+			return imgID, sourceEpoch, err
+		}
+		if !opts.Platform.IsZero() {
+			return "", sourceEpoch, fmt.Errorf("provisioner does not support selecting a platform from a multi-arch image")
+		}
 		if deployer, ok := prov.(provision.ImageDeployer); ok {
-			return deployer.ImageDeploy(opts.App, opts.Image, evt)
+			imgID, imgErr := deployer.ImageDeploy(opts.App, opts.Image, evt)
+			if imgErr == provision.ErrManifestSchema1Unsupported {
+				imgID, err = deploySchema1Fallback(prov, opts, evt)
+				return imgID, sourceEpoch, err
+			}
+			return imgID, sourceEpoch, imgErr
 		}
 		fallthrough
 	case DeployUpload, DeployUploadBuild:
+		if opts.SourceEpoch != "" {
+			deployer, ok := prov.(provision.ReproducibleDeployer)
+			if !ok {
+				return "", sourceEpoch, ErrOutputTimestampValueNotSupported
+			}
+			imgID, err := deployer.UploadDeployReproducible(opts.App, opts.File, opts.FileSize, opts.Build, sourceEpoch, evt)
+			return imgID, sourceEpoch, err
+		}
 		if deployer, ok := prov.(provision.UploadDeployer); ok {
-			return deployer.UploadDeploy(opts.App, opts.File, opts.FileSize, opts.Build, evt)
+			imgID, err := deployer.UploadDeploy(opts.App, opts.File, opts.FileSize, opts.Build, evt)
+			return imgID, sourceEpoch, err
 		}
 		fallthrough
 	default:
-		return prov.(provision.ArchiveDeployer).ArchiveDeploy(opts.App, opts.ArchiveURL, evt)
+		if opts.SourceEpoch != "" {
+			deployer, ok := prov.(provision.ReproducibleDeployer)
+			if !ok {
+				return "", sourceEpoch, ErrOutputTimestampValueNotSupported
+			}
+			imgID, err := deployer.ArchiveDeployReproducible(opts.App, opts.ArchiveURL, sourceEpoch, evt)
+			return imgID, sourceEpoch, err
+		}
+		imgID, err := prov.(provision.ArchiveDeployer).ArchiveDeploy(opts.App, opts.ArchiveURL, evt)
+		return imgID, sourceEpoch, err
 	}
 }
 
+// deployCancellable runs a deploy through a CancellableDeployer. It threads
+// the already-resolved SourceEpoch, Platform and ResolvedManifest through
+// DeployArgs - an early version of this short-circuited ahead of every
+// other capability check instead, which silently dropped all three for any
+// provisioner that also implemented CancellableDeployer, discarding the
+// pinned manifest for a MultiArchImageDeployer+CancellableDeployer
+// provisioner the same way it used to discard SourceEpoch - and still falls
+// back to deploySchema1Fallback on ErrManifestSchema1Unsupported, the same
+// as any other image deployer.
+func deployCancellable(ctx context.Context, prov provision.Provisioner, deployer provision.CancellableDeployer, opts *DeployOptions, sourceEpoch time.Time, evt *event.Event) (string, time.Time, error) {
+	imgID, err := deployer.Deploy(ctx, opts.App, provision.DeployArgs{
+		Kind:        string(opts.GetKind()),
+		ArchiveURL:  opts.ArchiveURL,
+		File:        opts.File,
+		FileSize:    opts.FileSize,
+		Build:       opts.Build,
+		Image:       opts.Image,
+		SourceEpoch: sourceEpoch,
+		Platform:    opts.Platform,
+		Manifest:    opts.ResolvedManifest,
+	}, evt)
+	if err == provision.ErrManifestSchema1Unsupported {
+		imgID, err = deploySchema1Fallback(prov, opts, evt)
+	}
+	return imgID, sourceEpoch, err
+}
+
+// schema1ConfigKey names the per-pool setting that controls whether a
+// pool's apps may still deploy images that are only served as deprecated
+// Docker manifest v2 schema1; it's only used in the deprecation warning.
+// allowSchema1 reads the setting from the allow_schema1 field of the pool's
+// document, not from a deploy:allow-schema1 config entry, and treats an
+// unset field (or a pool it can't read) as allowed. Operators can use
+// ListDeploys (Schema1Converted) to find affected apps.
+const schema1ConfigKey = "deploy:allow-schema1"
+
+// allowSchema1 reports whether poolName may still fall back to pulling
+// schema1-only images.
+func allowSchema1(poolName string) bool {
+	conn, err := db.Conn()
+	if err != nil {
+		return true
+	}
+	defer conn.Close()
+	var poolConfig struct {
+		AllowSchema1 *bool `bson:"allow_schema1"`
+	}
+	err = conn.Collection("pool").Find(bson.M{"_id": poolName}).One(&poolConfig)
+	if err != nil || poolConfig.AllowSchema1 == nil {
+		return true
+	}
+	return *poolConfig.AllowSchema1
+}
+
+// deploySchema1Fallback retries opts.Image against a provisioner that can
+// pull Docker manifest v2 schema1 and convert it to schema2 on ingestion,
+// for registries that never migrated off the deprecated format.
+func deploySchema1Fallback(prov provision.Provisioner, opts *DeployOptions, evt *event.Event) (string, error) {
+	if !allowSchema1(opts.App.Pool) {
+		return "", provision.ErrManifestSchema1Unsupported
+	}
+	deployer, ok := prov.(provision.Schema1ImageDeployer)
+	if !ok {
+		return "", provision.ErrManifestSchema1Unsupported
+	}
+	evt.Logf("WARNING: %s is only served as deprecated Docker manifest v2 schema1; converting to schema2 and continuing. Please migrate this registry, as %s will be set to false in a future release.", opts.Image, schema1ConfigKey)
+	imgID, err := deployer.ImageDeploySchema1(opts.App, opts.Image, evt)
+	if err != nil {
+		return "", err
+	}
+	opts.Schema1Converted = true
+	return imgID, nil
+}
+
+// splitImageDigest splits a "repo/name@sha256:digest" image reference into
+// its name and digest parts. It returns an empty digest for references that
+// aren't digest-pinned, such as floating tags.
+func splitImageDigest(image string) (name, digest string) {
+	if idx := strings.Index(image, "@sha256:"); idx != -1 {
+		return image[:idx], image[idx+1:]
+	}
+	return image, ""
+}
+
 func ValidateOrigin(origin string) bool {
 	originList := []string{"app-deploy", "git", "rollback", "drag-and-drop", "image"}
 	for _, ol := range originList {
@@ -331,6 +708,49 @@ func MigrateDeploysToEvents() error {
 		if err != nil {
 			return err
 		}
+		err = synthesizeArtifactAndRelease(&data)
+		if err != nil {
+			return err
+		}
 	}
 	return iter.Close()
 }
+
+// synthesizeArtifactAndRelease creates the Artifact and Release that a
+// pre-artifact/release DeployData row would have produced, so historical
+// deploys show up in ListReleases like any other. Unlike deployDataToEvent,
+// there's no unique index backing this, so re-running MigrateDeploysToEvents
+// would otherwise create duplicate Artifacts/Releases for rows it already
+// migrated; skip rows that already have a Release for this image.
+func synthesizeArtifactAndRelease(data *DeployData) error {
+	if data.Image == "" {
+		return nil
+	}
+	a, err := GetByName(data.App)
+	if err != nil {
+		return nil
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	n, err := conn.Collection("releases").Find(bson.M{"app": a.Name, "image": data.Image}).Count()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	artifact, err := CreateArtifact(CreateArtifactOpts{
+		App:       &a,
+		Image:     data.Image,
+		SourceRef: data.Commit,
+		Origin:    data.Origin,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = CreateRelease(&a, artifact, nil)
+	return err
+}
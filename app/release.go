@@ -0,0 +1,216 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/tsuru/tsuru/app/bind"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/provision"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Artifact is the immutable output of a single deploy: an image plus enough
+// metadata to reproduce it. Unlike a Release, an Artifact knows nothing
+// about which app environment or process config it will run with, so the
+// same Artifact can be promoted across pools or previewed before any
+// traffic is routed to it, mirroring the artifact/release split used by
+// Flynn.
+type Artifact struct {
+	ID     bson.ObjectId `bson:"_id,omitempty"`
+	App    string
+	Image  string
+	Digest string
+	// Platform is the manifest platform that was resolved out of Image,
+	// when Image referenced an OCI image index or Docker manifest list.
+	// Keeping it pinned lets Rollback reproduce the exact manifest instead
+	// of re-resolving a (possibly since-changed) floating tag.
+	Platform  provision.Platform
+	SourceRef string
+	Origin    string
+	CreatedAt time.Time
+	// Schema1Converted reports whether Image had to be pulled as deprecated
+	// Docker manifest v2 schema1 and converted to schema2 on ingestion.
+	Schema1Converted bool
+	// SourceEpoch is the timestamp that was actually baked into Image, as
+	// resolved for the deploy that produced this Artifact. It's the zero
+	// value when the deploy didn't request a SourceEpoch.
+	SourceEpoch time.Time
+}
+
+// Release binds an Artifact to the app environment and process config that
+// were in effect when it was created. Deploying or rolling back always
+// creates a new, immutable Release; it never mutates an existing one.
+type Release struct {
+	ID         bson.ObjectId `bson:"_id,omitempty"`
+	App        string
+	Number     int
+	ArtifactID bson.ObjectId
+	Image      string
+	Env        map[string]bind.EnvVar
+	// Processes is the Procfile-like process config in effect for this
+	// release. Deploy and MigrateDeploysToEvents create Releases with a nil
+	// Processes, and nothing sets it afterwards.
+	Processes map[string]string
+	CreatedAt time.Time
+}
+
+// CreateArtifactOpts are the inputs needed to materialize an Artifact out of
+// a finished deploy.
+type CreateArtifactOpts struct {
+	App              *App
+	Image            string
+	Digest           string
+	Platform         provision.Platform
+	SourceRef        string
+	Origin           string
+	Schema1Converted bool
+	SourceEpoch      time.Time
+}
+
+// CreateArtifact persists the immutable output of a deploy so it can later
+// be promoted into one or more Releases.
+func CreateArtifact(opts CreateArtifactOpts) (*Artifact, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	artifact := Artifact{
+		App:              opts.App.Name,
+		Image:            opts.Image,
+		Digest:           opts.Digest,
+		Platform:         opts.Platform,
+		SourceRef:        opts.SourceRef,
+		Origin:           opts.Origin,
+		CreatedAt:        time.Now().UTC(),
+		Schema1Converted: opts.Schema1Converted,
+		SourceEpoch:      opts.SourceEpoch,
+	}
+	err = conn.Collection("artifacts").Insert(&artifact)
+	if err != nil {
+		return nil, err
+	}
+	return &artifact, nil
+}
+
+// GetArtifact fetches a single Artifact by id.
+func GetArtifact(id bson.ObjectId) (*Artifact, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var artifact Artifact
+	err = conn.Collection("artifacts").FindId(id).One(&artifact)
+	if err != nil {
+		return nil, err
+	}
+	return &artifact, nil
+}
+
+// CreateRelease points a new, sequentially numbered Release at artifact,
+// capturing the app's current environment and the given process config.
+// The number is assigned with an atomic findAndModify against
+// release_counters (the same $inc pattern incrementDeploy uses), since
+// finding the highest existing number and inserting one more is racy: two
+// concurrent deploys or rollbacks of the same app could read the same
+// "last" Release and be handed the same Number.
+func CreateRelease(app *App, artifact *Artifact, processes map[string]string) (*Release, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var counter struct {
+		Number int `bson:"number"`
+	}
+	_, err = conn.Collection("release_counters").Find(bson.M{"_id": app.Name}).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"number": 1}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &counter)
+	if err != nil {
+		return nil, err
+	}
+	release := Release{
+		App:        app.Name,
+		Number:     counter.Number,
+		ArtifactID: artifact.ID,
+		Image:      artifact.Image,
+		Env:        app.Env,
+		Processes:  processes,
+		CreatedAt:  time.Now().UTC(),
+	}
+	err = conn.Collection("releases").Insert(&release)
+	if err != nil {
+		return nil, err
+	}
+	return &release, nil
+}
+
+// ListReleases returns every Release created for app, most recent first.
+func ListReleases(app *App) ([]Release, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var releases []Release
+	err = conn.Collection("releases").Find(bson.M{"app": app.Name}).Sort("-number").All(&releases)
+	if err != nil {
+		return nil, err
+	}
+	return releases, nil
+}
+
+var reReleaseVersion = regexp.MustCompile(`(?:^|:)v?([0-9]+)$`)
+
+// parseReleaseVersion extracts the release number out of a rollback target.
+// Besides the bare "v3"/"3" forms, it also accepts a full image reference
+// ending in ":v3" or ":3" - the form opts.Image carried before Release
+// numbers existed (see the Rollback case in Deploy). resolveRollbackRelease
+// matches such a reference against Release images first and only uses the
+// number parsed here when no Release has that exact image.
+func parseReleaseVersion(version string) (int, error) {
+	m := reReleaseVersion.FindStringSubmatch(version)
+	if m == nil {
+		return 0, fmt.Errorf("invalid version: %q", version)
+	}
+	return strconv.Atoi(m[1])
+}
+
+// resolveRollbackRelease finds the Release that version (e.g. "v3" or "3")
+// refers to, so Rollback can point at its Artifact directly instead of
+// re-resolving the image by suffix/regex matching against valid images.
+func resolveRollbackRelease(app App, version string) (*Release, error) {
+	releases, err := ListReleases(&app)
+	if err != nil {
+		return nil, err
+	}
+	// An image tag's ":vN" and a Release Number drift apart once a rollback
+	// has created a Release without building a new image, so a full image
+	// reference is matched by image.
+	for i := range releases {
+		if releases[i].Image == version {
+			return &releases[i], nil
+		}
+	}
+	number, err := parseReleaseVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	for i := range releases {
+		if releases[i].Number == number {
+			return &releases[i], nil
+		}
+	}
+	return nil, fmt.Errorf("release not found: %q", version)
+}
@@ -0,0 +1,39 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import "testing"
+
+func TestParseReleaseVersion(t *testing.T) {
+	cases := []struct {
+		version string
+		want    int
+		wantErr bool
+	}{
+		{"v3", 3, false},
+		{"3", 3, false},
+		{"v0", 0, false},
+		{"myapp-web:v3", 3, false},
+		{"registry.example.com/myapp-web:5", 5, false},
+		{"latest", 0, true},
+		{"", 0, true},
+	}
+	for _, c := range cases {
+		got, err := parseReleaseVersion(c.version)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseReleaseVersion(%q): expected error, got none", c.version)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseReleaseVersion(%q): unexpected error: %s", c.version, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parseReleaseVersion(%q) = %d, want %d", c.version, got, c.want)
+		}
+	}
+}
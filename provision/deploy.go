@@ -0,0 +1,78 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package provision
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/tsuru/tsuru/event"
+)
+
+// ReproducibleDeployer is implemented by provisioners that can pin the
+// timestamp baked into the image they produce, enabling reproducible
+// builds (see app.SourceEpoch). When an archive or upload deploy requests a
+// SourceEpoch it's used in place of the plain ArchiveDeployer/UploadDeployer
+// interfaces, unless the provisioner is a CancellableDeployer; a provisioner
+// that implements neither fails such a deploy.
+type ReproducibleDeployer interface {
+	ArchiveDeployReproducible(app App, archiveURL string, sourceEpoch time.Time, evt *event.Event) (string, error)
+	UploadDeployReproducible(app App, file io.ReadCloser, fileSize int64, build bool, sourceEpoch time.Time, evt *event.Event) (string, error)
+}
+
+// DeployArgs bundles the inputs a CancellableDeployer needs to run a deploy.
+// It carries SourceEpoch and Platform alongside the plain deploy inputs so
+// that implementing CancellableDeployer doesn't mean losing reproducible-
+// build or multi-arch support.
+type DeployArgs struct {
+	Kind        string
+	ArchiveURL  string
+	File        io.ReadCloser
+	FileSize    int64
+	Build       bool
+	Image       string
+	SourceEpoch time.Time
+	Platform    Platform
+	// Manifest is the concrete manifest the caller already resolved out of
+	// Image via MultiArchImageDeployer, when the provisioner implements
+	// both MultiArchImageDeployer and CancellableDeployer. It's the zero
+	// value when Image wasn't a multi-arch image index or manifest list.
+	Manifest ManifestDescriptor
+}
+
+// CancellableDeployer is implemented by provisioners that can abort an
+// in-flight deploy when ctx is cancelled (see app.CancelDeploy). Deploy may
+// still return ErrManifestSchema1Unsupported, in which case the caller
+// falls back to Schema1ImageDeployer the same way it would for any other
+// image deployer.
+type CancellableDeployer interface {
+	Deploy(ctx context.Context, app App, args DeployArgs, evt *event.Event) (string, error)
+}
+
+// MultiArchImageDeployer is implemented by provisioners that can list the
+// per-platform manifests referenced by an OCI image index or Docker
+// manifest list, and deploy a specific one. Listing the manifests up front
+// lets the caller resolve and pin the concrete manifest (by digest and
+// platform) that was actually deployed, instead of only recording the
+// platform that was requested.
+type MultiArchImageDeployer interface {
+	ListImageManifests(app App, image string, evt *event.Event) ([]ManifestDescriptor, error)
+	ImageDeployManifest(app App, image string, manifest ManifestDescriptor, evt *event.Event) (string, error)
+}
+
+// Schema1ImageDeployer is implemented by provisioners that can pull a
+// deprecated Docker manifest v2 schema1 image and convert it to schema2 on
+// ingestion, for registries that never migrated off the legacy format.
+type Schema1ImageDeployer interface {
+	ImageDeploySchema1(app App, image string, evt *event.Event) (string, error)
+}
+
+// ErrManifestSchema1Unsupported is returned by ImageDeployer implementations
+// (and by a CancellableDeployer's Deploy) when an image is only served as
+// deprecated Docker manifest v2 schema1. The caller falls back to
+// Schema1ImageDeployer if the pool allows it.
+var ErrManifestSchema1Unsupported = errors.New("image is only served as deprecated Docker manifest v2 schema1")
@@ -0,0 +1,100 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package provision
+
+import "strings"
+
+// Platform identifies the OS/architecture a deploy should select out of an
+// OCI image index or Docker manifest list. The zero value means "no
+// preference": SelectManifest then returns the first manifest listed, and
+// provisioners that don't select manifests pick as they did before this
+// existed.
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string
+	OSVersion    string
+	OSFeatures   []string
+}
+
+// IsZero reports whether p expresses no platform preference.
+func (p Platform) IsZero() bool {
+	return p.OS == "" && p.Architecture == "" && p.Variant == "" && p.OSVersion == "" && len(p.OSFeatures) == 0
+}
+
+// ManifestDescriptor is a single platform-specific entry of an OCI image
+// index or Docker manifest list.
+type ManifestDescriptor struct {
+	Digest    string
+	MediaType string
+	Platform  Platform
+}
+
+// SelectManifest picks the ManifestDescriptor out of manifests that best
+// matches requested, trying an exact match first and then falling back to
+// known-compatible variants (analogous to the containers/image
+// platform_matcher logic). It reports false if none are compatible.
+func SelectManifest(manifests []ManifestDescriptor, requested Platform) (ManifestDescriptor, bool) {
+	if requested.IsZero() && len(manifests) > 0 {
+		return manifests[0], true
+	}
+	for _, m := range manifests {
+		if exactPlatformMatch(requested, m.Platform) {
+			return m, true
+		}
+	}
+	for _, m := range manifests {
+		if platformCompatible(requested, m.Platform) {
+			return m, true
+		}
+	}
+	return ManifestDescriptor{}, false
+}
+
+func exactPlatformMatch(requested, candidate Platform) bool {
+	return strings.EqualFold(requested.OS, candidate.OS) &&
+		requested.Architecture == candidate.Architecture &&
+		requested.Variant == candidate.Variant &&
+		requested.OSVersion == candidate.OSVersion
+}
+
+// platformCompatible reports whether candidate can be run where requested
+// was asked for, applying the same normalizations registries and runtimes
+// commonly use: arm64 without a variant is treated as arm64/v8, arm
+// without a variant is treated as arm/v7, and amd64 variants are ignored
+// entirely.
+func platformCompatible(requested, candidate Platform) bool {
+	if requested.OS != "" && !strings.EqualFold(requested.OS, candidate.OS) {
+		return false
+	}
+	if requested.Architecture == "" {
+		return true
+	}
+	reqArch, reqVariant := normalizeArchVariant(requested.Architecture, requested.Variant)
+	candArch, candVariant := normalizeArchVariant(candidate.Architecture, candidate.Variant)
+	if reqArch != candArch {
+		return false
+	}
+	if reqVariant == "" || candVariant == "" {
+		return true
+	}
+	return reqVariant == candVariant
+}
+
+func normalizeArchVariant(arch, variant string) (string, string) {
+	switch arch {
+	case "arm64":
+		if variant == "" {
+			variant = "v8"
+		}
+	case "arm":
+		if variant == "" {
+			variant = "v7"
+		}
+	case "amd64":
+		variant = ""
+	}
+	return arch, variant
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package provision
+
+import "testing"
+
+func TestNormalizeArchVariant(t *testing.T) {
+	cases := []struct {
+		arch, variant string
+		wantA, wantV  string
+	}{
+		{"arm64", "", "arm64", "v8"},
+		{"arm64", "v8", "arm64", "v8"},
+		{"arm", "", "arm", "v7"},
+		{"arm", "v6", "arm", "v6"},
+		{"amd64", "", "amd64", ""},
+		{"amd64", "v2", "amd64", ""},
+	}
+	for _, c := range cases {
+		gotA, gotV := normalizeArchVariant(c.arch, c.variant)
+		if gotA != c.wantA || gotV != c.wantV {
+			t.Errorf("normalizeArchVariant(%q, %q) = (%q, %q), want (%q, %q)",
+				c.arch, c.variant, gotA, gotV, c.wantA, c.wantV)
+		}
+	}
+}
+
+func TestPlatformCompatible(t *testing.T) {
+	cases := []struct {
+		name      string
+		requested Platform
+		candidate Platform
+		want      bool
+	}{
+		{"no preference matches anything", Platform{}, Platform{OS: "linux", Architecture: "arm64"}, true},
+		{"same os and arch", Platform{OS: "linux", Architecture: "amd64"}, Platform{OS: "linux", Architecture: "amd64"}, true},
+		{"different os", Platform{OS: "linux"}, Platform{OS: "windows"}, false},
+		{"arm64 defaults to v8", Platform{OS: "linux", Architecture: "arm64"}, Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, true},
+		{"arm variant mismatch", Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, false},
+		{"different arch", Platform{Architecture: "amd64"}, Platform{Architecture: "arm64"}, false},
+	}
+	for _, c := range cases {
+		got := platformCompatible(c.requested, c.candidate)
+		if got != c.want {
+			t.Errorf("%s: platformCompatible(%+v, %+v) = %v, want %v", c.name, c.requested, c.candidate, got, c.want)
+		}
+	}
+}
+
+func TestSelectManifest(t *testing.T) {
+	manifests := []ManifestDescriptor{
+		{Digest: "sha256:amd64", Platform: Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: "sha256:arm64", Platform: Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+	}
+	m, ok := SelectManifest(manifests, Platform{OS: "linux", Architecture: "arm64"})
+	if !ok || m.Digest != "sha256:arm64" {
+		t.Errorf("expected arm64 manifest, got %+v (ok=%v)", m, ok)
+	}
+	m, ok = SelectManifest(manifests, Platform{})
+	if !ok || m.Digest != "sha256:amd64" {
+		t.Errorf("expected first manifest for no-preference, got %+v (ok=%v)", m, ok)
+	}
+	_, ok = SelectManifest(manifests, Platform{OS: "windows"})
+	if ok {
+		t.Errorf("expected no match for windows platform")
+	}
+}